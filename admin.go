@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/aristanetworks/glog"
+)
+
+// reloadStatus is the last outcome of loading a Config, whether at startup or from a later
+// SIGHUP. It backs the /configz endpoint so an operator scripting reloads can tell whether one
+// actually took effect.
+type reloadStatus struct {
+	mu      sync.Mutex
+	cfg     *Config
+	lastErr error
+}
+
+// record stores the result of a (re)load. On failure, cfg is left as whatever last succeeded;
+// only lastErr moves, so /configz keeps reporting the configuration actually in effect.
+func (s *reloadStatus) record(cfg *Config, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.cfg = cfg
+	}
+	s.lastErr = err
+}
+
+func (s *reloadStatus) snapshot() (*Config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg, s.lastErr
+}
+
+// configzResponse is the JSON body served at /configz.
+type configzResponse struct {
+	Config          *Config `json:"config"`
+	LastReloadError string  `json:"last_reload_error,omitempty"`
+}
+
+// serveAdmin runs the /healthz and /configz HTTP endpoints on addr until the process exits.
+// /healthz just reports that the process is up and serving; /configz reports the configuration
+// currently in effect and the error from the last reload attempt, if any.
+func serveAdmin(addr string, status *reloadStatus) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/configz", func(w http.ResponseWriter, r *http.Request) {
+		cfg, err := status.snapshot()
+		resp := configzResponse{Config: cfg}
+		if err != nil {
+			resp.LastReloadError = err.Error()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+
+	glog.Infof("Serving /healthz and /configz on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		glog.Errorf("Admin HTTP server on %s exited: %v", addr, err)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import "time"
+
+// IPAllocator manages the IP addresses handed out to an interface's configuration. Each target
+// gets its own instance (see Manager.allocatorFor); this interface replaces the old bare
+// ipDBManager so that we can plug in different backing stores (in-memory, persistent) behind the
+// same state machine code.
+type IPAllocator interface {
+	// GetIP returns the interface's existing lease if it has one, or assigns and returns a new
+	// one. ok is false when no lease exists yet and new assignments are being withheld until
+	// MarkSynced has been called, or the backing pool is exhausted.
+	GetIP(iface string) (prefix string, prefixLen int, ok bool)
+
+	// Reconcile checks whether prefix/prefixLen is already this interface's lease (claiming it
+	// as one if it's free), and otherwise assigns a new lease. It returns the interface's
+	// resulting prefix/prefixLen and whether the one passed in was already correct.
+	Reconcile(iface, prefix string, prefixLen int) (string, int, bool)
+
+	// ReleaseIP starts the interface's lease TTL. The IP isn't actually returned to the pool
+	// until the TTL elapses without GetIP or Reconcile reclaiming it for the same interface.
+	ReleaseIP(iface string)
+
+	// MarkSynced records that the first gNMI sync for this allocator's target has completed.
+	// Until it's called, GetIP will only return leases that already exist (eg. restored from a
+	// persistent backend), never assign fresh ones, so that a lease restored for an interface
+	// we haven't heard from yet can't be handed out to a different one in the meantime.
+	MarkSynced()
+
+	// Snapshot and Restore serialize and reload the allocator's full lease state. Persistent
+	// backends use them to survive a restart; the "memory" backend never calls them.
+	Snapshot() ([]byte, error)
+	Restore(data []byte) error
+
+	// Reconfigure applies a new pool/lease-TTL configuration picked up from a config reload.
+	// Pools that disappeared keep serving their existing leases (draining) but stop handing out
+	// new addresses; pools that are still present keep their current address ownership, so
+	// existing leases survive the reload. It returns the interfaces whose pool's prefix length
+	// changed, so the caller can push them back through configured() to re-setPrefix.
+	Reconfigure(pools []Pool, leaseTTL time.Duration) (affected []string, err error)
+}
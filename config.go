@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// duration wraps time.Duration so it can be loaded from YAML as a human string like "5m",
+// matching the format flag.Duration already accepts on the command line.
+type duration time.Duration
+
+func (d *duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// Config holds every setting that can be changed without restarting inogf: the IP pools, how
+// long a downed interface keeps its lease, log verbosity, and which gNMI paths are subscribed to.
+// It's loaded once at startup and again on every SIGHUP; see reloader.
+type Config struct {
+	Pools          []Pool   `yaml:"pools"`
+	LeaseTTL       duration `yaml:"lease-ttl"`
+	Verbosity      int32    `yaml:"verbosity"`
+	SubscribePaths []string `yaml:"subscribe-paths"`
+}
+
+// loadConfig reads a Config from a YAML file of the form:
+//
+//	pools:
+//	  - name: ethernet
+//	    cidr: 10.0.0.0/16
+//	    iface-regex: "Ethernet.*"
+//	    prefix-length: 24
+//	lease-ttl: 5m
+//	verbosity: 2
+//	subscribe-paths:
+//	  - /interfaces/interface/state/admin-status
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if len(cfg.Pools) == 0 {
+		cfg.Pools = defaultPools()
+	}
+	if len(cfg.SubscribePaths) == 0 {
+		cfg.SubscribePaths = []string{adminStatusPath, ipv4AddressPath}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aristanetworks/glog"
+	"github.com/aristanetworks/goarista/gnmi"
+	pb "github.com/openconfig/gnmi/proto/gnmi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	dialout "github.com/wladh/inogf/dialoutpb"
+)
+
+// targetMetadataKey is the gRPC metadata key a device dialing out is expected to identify itself
+// with, since the Publish RPC itself carries no target field.
+const targetMetadataKey = "target"
+
+// dialoutServer implements the gNMIDialout Publish service. Instead of us dialing the device and
+// subscribing, the device dials us and pushes its own SubscribeResponse stream.
+type dialoutServer struct {
+	msgChan chan *message
+}
+
+// Publish implements the gNMIDialOut service. It reads the SubscribeResponses pushed by one
+// device and forwards them, tagged with the originating target, onto the channel shared with
+// eventLoop. A device reconnecting, restarting, or blipping its connection ends only this one
+// stream: that's routine in dial-out telemetry, so it's logged and dropped here rather than
+// reported anywhere eventLoop would treat as fatal for every other connected device.
+func (s *dialoutServer) Publish(stream dialout.GNMIDialOut_PublishServer) error {
+	target, ok := targetFromMetadata(stream.Context())
+	if ok {
+		glog.V(2).Infof("Accepted dial-out connection from %s", target)
+	} else {
+		glog.V(2).Infof("Accepted dial-out connection with no %q metadata; identifying it from "+
+			"its first Notification instead", targetMetadataKey)
+	}
+
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			glog.V(2).Infof("Dial-out stream from %s closed", target)
+			return stream.SendAndClose(&emptypb.Empty{})
+		}
+		if err != nil {
+			glog.Errorf("Dial-out stream from %s ended: %v", target, err)
+			return err
+		}
+		if !ok {
+			if target = targetFromNotification(resp); target != "" {
+				ok = true
+			} else {
+				// Neither metadata nor this Notification's prefix carried a target, so we have
+				// nothing to dial back into; fall back to the peer address just so updates from
+				// different unidentified devices don't get merged into one target.
+				target = targetFromPeer(stream.Context())
+			}
+		}
+		s.msgChan <- &message{target: target, resp: resp}
+	}
+}
+
+// targetFromMetadata reads the target a device identified itself with in its Publish call's gRPC
+// metadata, the normal way a dial-out device tells us who it is.
+func targetFromMetadata(ctx context.Context) (string, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", false
+	}
+	vals := md.Get(targetMetadataKey)
+	if len(vals) == 0 || vals[0] == "" {
+		return "", false
+	}
+	return vals[0], true
+}
+
+// targetFromNotification falls back to the target carried in a Notification's own prefix, for
+// devices that identify themselves there instead of (or in addition to) stream metadata.
+func targetFromNotification(resp *pb.SubscribeResponse) string {
+	upd, ok := resp.Response.(*pb.SubscribeResponse_Update)
+	if !ok {
+		return ""
+	}
+	return upd.Update.GetPrefix().GetTarget()
+}
+
+// targetFromPeer is the last resort when a device identifies itself neither via metadata nor a
+// Notification prefix: the TCP peer address of its outbound connection. dialBackClientProvider
+// can't dial back into this, so config push-back won't work for such a device, but it at least
+// keeps its updates from merging with another unidentified device's.
+func targetFromPeer(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return "unknown"
+}
+
+// runDialOut starts a gRPC server implementing the gNMIDialout Publish service on listenAddr and
+// feeds the notifications it receives into the same eventLoop used for dial-in. Since the server
+// only receives a stream from each device, configuring an interface still requires dialing back
+// into the target using cfg's credentials, which dialBackClientProvider does lazily. If
+// configFile is set, its pools/lease-TTL/verbosity are reloaded on SIGHUP; unlike dial-in, there's
+// no outbound Subscribe here for a changed subscribe path set to re-open, since it's the device,
+// not us, that decides what it pushes.
+func runDialOut(cfg *gnmi.Config, listenAddr, certFile, keyFile string,
+	newAllocator func(target string, pools []Pool, leaseTTL time.Duration) (IPAllocator, error),
+	liveCfg *Config, configFile string, status *reloadStatus) error {
+	lis, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+
+	var opts []grpc.ServerOption
+	if certFile != "" && keyFile != "" {
+		creds, err := credentials.NewServerTLSFromFile(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+
+	msgChan := make(chan *message)
+	errChan := make(chan error)
+	defer close(msgChan)
+	defer close(errChan)
+
+	grpcServer := grpc.NewServer(opts...)
+	dialout.RegisterGNMIDialOutServer(grpcServer, &dialoutServer{msgChan: msgChan})
+
+	go func() {
+		if err := grpcServer.Serve(lis); err != nil {
+			errChan <- err
+		}
+	}()
+
+	ctx := gnmi.NewContext(context.Background(), cfg)
+
+	mgr := NewManager(ctx, dialBackClientProvider(cfg), newAllocator, liveCfg)
+
+	var sig chan os.Signal
+	var reloadWG sync.WaitGroup
+	if configFile != "" {
+		reload := newReloader(configFile, liveCfg, mgr, status, func(paths []string) {
+			glog.Infof("Subscribed paths changed on reload, but -mode=dialout has no outbound " +
+				"Subscribe to re-open; the device decides what it pushes")
+		})
+		sig = make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGHUP)
+		reloadWG.Add(1)
+		go func() {
+			defer reloadWG.Done()
+			reload.watch(sig)
+		}()
+	}
+	// Stop any further SIGHUPs and let watch's range loop drain before Shutdown starts closing
+	// sm.events channels: otherwise a reload landing mid-Reconfigure could still be dispatching to
+	// a state machine whose channel Shutdown has just closed out from under it.
+	defer func() {
+		if sig != nil {
+			signal.Stop(sig)
+			close(sig)
+			reloadWG.Wait()
+		}
+		mgr.Shutdown()
+	}()
+
+	return eventLoop(mgr, msgChan, errChan)
+}
+
+// dialBackClientProvider returns a clientProvider that dials back into each target the first
+// time it's asked for, reusing cfg's credentials, and caches the resulting client for later
+// calls. Unlike in dial-in mode, several interfaceSm goroutines (one per target and interface,
+// across many targets) can call this
+// concurrently, so the cache needs a lock; gnmi.Dial can block (DNS, TCP handshake, TLS), so it's
+// called with the lock released, the same reasoning as Manager.allocatorFor, to keep one target's
+// slow dial-back from stalling every other target's lookup.
+func dialBackClientProvider(cfg *gnmi.Config) clientProvider {
+	var mu sync.Mutex
+	clients := make(map[string]pb.GNMIClient)
+
+	return func(target string) (pb.GNMIClient, error) {
+		mu.Lock()
+		if client, ok := clients[target]; ok {
+			mu.Unlock()
+			return client, nil
+		}
+		mu.Unlock()
+
+		targetCfg := *cfg
+		targetCfg.Addr = target
+		client, err := gnmi.Dial(&targetCfg)
+		if err != nil {
+			return nil, err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if existing, ok := clients[target]; ok {
+			return existing, nil
+		}
+		clients[target] = client
+		return client, nil
+	}
+}
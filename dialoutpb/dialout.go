@@ -0,0 +1,52 @@
+// Package dialoutpb is a hand-trimmed stand-in for the gNMIDialOut service OpenConfig defines in
+// dialout_gnmi.proto. Unlike gnmi.proto itself, OpenConfig never published Go bindings for it, so
+// there's no github.com/openconfig/gnmi/proto/dialout_gnmi package to import; every dial-out
+// implementation vendors its own. This one is written by hand in the shape protoc-gen-go-grpc
+// would produce, trimmed to just the Publish RPC inogf's dial-out mode uses.
+package dialoutpb
+
+import (
+	pb "github.com/openconfig/gnmi/proto/gnmi"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// GNMIDialOut_PublishServer is the server side of the Publish RPC: a device streams its own
+// SubscribeResponses to us and gets a single empty response back once it closes the stream.
+type GNMIDialOut_PublishServer = grpc.ClientStreamingServer[pb.SubscribeResponse, emptypb.Empty]
+
+// GNMIDialOutServer is the server API for the gNMIDialOut service.
+type GNMIDialOutServer interface {
+	Publish(GNMIDialOut_PublishServer) error
+}
+
+// UnimplementedGNMIDialOutServer should be embedded to have forward compatible implementations.
+type UnimplementedGNMIDialOutServer struct{}
+
+func (UnimplementedGNMIDialOutServer) Publish(GNMIDialOut_PublishServer) error {
+	return status.Errorf(codes.Unimplemented, "method Publish not implemented")
+}
+
+// RegisterGNMIDialOutServer registers srv as the implementation of the gNMIDialOut service.
+func RegisterGNMIDialOutServer(s grpc.ServiceRegistrar, srv GNMIDialOutServer) {
+	s.RegisterService(&gNMIDialOutServiceDesc, srv)
+}
+
+func gNMIDialOutPublishHandler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(GNMIDialOutServer).Publish(&grpc.GenericServerStream[pb.SubscribeResponse, emptypb.Empty]{ServerStream: stream})
+}
+
+var gNMIDialOutServiceDesc = grpc.ServiceDesc{
+	ServiceName: "gnmi.gNMIDialOut",
+	HandlerType: (*GNMIDialOutServer)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Publish",
+			Handler:       gNMIDialOutPublishHandler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "dialout_gnmi.proto",
+}
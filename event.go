@@ -1,111 +1,211 @@
 package main
 
 import (
-	"context"
 	"errors"
-	"path"
-	"regexp"
+	"strconv"
 
 	"github.com/aristanetworks/glog"
 	"github.com/aristanetworks/goarista/gnmi"
 	pb "github.com/openconfig/gnmi/proto/gnmi"
-)
 
-// The types of events we deal with.
-const (
-	unknownEvent     = 0
-	adminStatusEvent = 1
-	prefixEvent      = 2
-	prefixLenEvent   = 3
+	"github.com/wladh/inogf/oc"
 )
 
-// This structure encapsulates the event type and data associated with it.
-type event struct {
-	evType int
-	iface  string
+// message pairs a SubscribeResponse with the target it was received from, so that dial-in and
+// dial-out sessions can be fed into the same eventLoop.
+type message struct {
+	target string
+	resp   *pb.SubscribeResponse
 }
 
-// Regular expressions to match the path for each of the leaves we're interested in and to extract
-// the interface name.
-// This is not a good way to do things. In a real system, you'd probably want to parse and validate
-// these updates (using probably something like goyang).
-var eventsRe = map[int]*regexp.Regexp{
-	adminStatusEvent: regexp.MustCompile("/interfaces/interface\\[name=(Ethernet[^]]*)\\]/state/admin-status"),
-	prefixEvent:      regexp.MustCompile("/interfaces/interface\\[name=(Ethernet[^]]*)\\]/.*/address\\[ip=[^]]*\\]/state/ip"),
-	prefixLenEvent:   regexp.MustCompile("/interfaces/interface\\[name=(Ethernet[^]]*)\\]/.*/address\\[ip=[^]]*\\]/state/prefix-length"),
+// clientProvider resolves the gNMI client that should be used to push configuration to the given
+// target. In dial-in mode this is always the client we dialed out with; in dial-out mode we have
+// to dial back into whichever device pushed us the notification.
+type clientProvider func(target string) (pb.GNMIClient, error)
+
+// ifUpdate carries everything a single Notification told us about one (interface, subinterface)
+// pair, so it can be applied to the state machine atomically instead of leaf by leaf. A nil
+// field means that leaf wasn't touched by this notification.
+type ifUpdate struct {
+	target   string
+	iface    string
+	subIndex uint32
+
+	adminStatus oc.AdminStatus // oc.AdminStatus_UNSET if not present in this notification
+	prefix      *string
+	prefixLen   *int
+	// prefixDeleted is set when this notification deleted the interface's ipv4 address rather
+	// than setting it (ie. it came in via Notification.Delete, not Notification.Update).
+	prefixDeleted bool
 }
 
-// Parses the gNMI notification paths against the regexp map above and returns the
-// corresponding event.
-func getEvent(path string) *event {
-	for evType, re := range eventsRe {
-		if groups := re.FindStringSubmatch(path); groups != nil {
-			return &event{
-				evType: evType,
-				iface:  groups[1],
+// resolveLeaf walks path's elements against the YANG schema loaded by loadSchema, both to
+// validate that it refers to a real leaf (rather than trusting a regexp to have gotten it right)
+// and to pull out the interface name, subinterface index and address key carried as list keys
+// along the way. ok is false if the path doesn't match the schema at all.
+func resolveLeaf(p *pb.Path) (ifName string, subIndex uint32, addrIP string, leaf string, ok bool) {
+	entry := schema
+	for _, elem := range p.Elem {
+		next, exists := entry.Dir[elem.Name]
+		if !exists {
+			return "", 0, "", "", false
+		}
+		entry = next
+
+		switch elem.Name {
+		case "interface":
+			ifName = elem.Key["name"]
+		case "subinterface":
+			if idx, err := strconv.Atoi(elem.Key["index"]); err == nil {
+				subIndex = uint32(idx)
 			}
+		case "address":
+			addrIP = elem.Key["ip"]
 		}
 	}
+	if ifName == "" || !entry.IsLeaf() {
+		return "", 0, "", "", false
+	}
+	return ifName, subIndex, addrIP, entry.Name, true
+}
 
-	return &event{evType: unknownEvent}
+// absPath concatenates a notification's prefix and an update/delete path into a single path.
+func absPath(prefix, p *pb.Path) *pb.Path {
+	elem := append(append([]*pb.PathElem{}, prefix.GetElem()...), p.GetElem()...)
+	return &pb.Path{Elem: elem}
 }
 
-// Finds the corresponding state machine object for the interface and dispatches the event to
-// the right handler.
-func dispatchEvent(ctx context.Context, client pb.GNMIClient, ev *event, value string) {
-	switch ev.evType {
-	case adminStatusEvent:
-		getInterfaceSm(ctx, client, ev.iface).adminStatusEventHandler(ev, value)
-	case prefixEvent:
-		getInterfaceSm(ctx, client, ev.iface).prefixEventHandler(ev, value)
-	case prefixLenEvent:
-		getInterfaceSm(ctx, client, ev.iface).prefixLenEventHandler(ev, value)
-	default:
-		glog.Errorf("Unknown event: %#v", ev)
+// subKey identifies a (interface, subinterface) pair touched within a single notification.
+type subKey struct {
+	iface    string
+	subIndex uint32
+}
+
+// parseNotification replaces the old regexp-based getEvent: it resolves every Update and Delete
+// in a Notification against the YANG schema, unmarshals them into the same typed oc.Interface
+// representation ygot.Unmarshal would produce, and returns one ifUpdate per (interface,
+// subinterface) pair touched, so that eventLoop can apply everything the notification told us in
+// one atomic step instead of waiting, leaf by leaf, for a timer.
+func parseNotification(n *pb.Notification, target string) []*ifUpdate {
+	ifaces := map[string]*oc.Interface{}
+	iface := func(name string) *oc.Interface {
+		i, ok := ifaces[name]
+		if !ok {
+			i = &oc.Interface{Name: name}
+			ifaces[name] = i
+		}
+		return i
 	}
+
+	touched := map[subKey]bool{}
+	deleted := map[subKey]bool{}
+
+	for _, u := range n.Update {
+		p := absPath(n.Prefix, u.Path)
+		ifName, subIndex, addrIP, leaf, ok := resolveLeaf(p)
+		if !ok {
+			glog.V(5).Infof("Ignoring update for unknown path %s", gnmi.StrPath(p))
+			continue
+		}
+		value := gnmi.StrUpdateVal(u)
+		touched[subKey{ifName, subIndex}] = true
+
+		switch leaf {
+		case "admin-status":
+			var status oc.AdminStatus
+			switch value {
+			case "UP":
+				status = oc.AdminStatus_UP
+			case "DOWN":
+				status = oc.AdminStatus_DOWN
+			default:
+				glog.Errorf("Unknown admin state: %s", value)
+				continue
+			}
+			iface(ifName).AdminStatus = status
+		case "ip":
+			iface(ifName).Address(subIndex, addrIP)
+		case "prefix-length":
+			prefixLen, err := strconv.Atoi(value)
+			if err != nil {
+				glog.Errorf("Invalid prefix len: %s", value)
+				continue
+			}
+			pl := uint8(prefixLen)
+			iface(ifName).Address(subIndex, addrIP).PrefixLength = &pl
+		}
+	}
+
+	for _, d := range n.Delete {
+		p := absPath(n.Prefix, d)
+		ifName, subIndex, _, leaf, ok := resolveLeaf(p)
+		if !ok || leaf != "ip" {
+			continue
+		}
+		touched[subKey{ifName, subIndex}] = true
+		deleted[subKey{ifName, subIndex}] = true
+	}
+
+	result := make([]*ifUpdate, 0, len(touched))
+	for k := range touched {
+		u := &ifUpdate{target: target, iface: k.iface, subIndex: k.subIndex, prefixDeleted: deleted[k]}
+
+		if oci, ok := ifaces[k.iface]; ok {
+			u.adminStatus = oci.AdminStatus
+			if sub, ok := oci.Subinterface[k.subIndex]; ok && sub.Ipv4 != nil {
+				for ip, addr := range sub.Ipv4.Address {
+					ip := ip
+					u.prefix = &ip
+					if addr.PrefixLength != nil {
+						prefixLen := int(*addr.PrefixLength)
+						u.prefixLen = &prefixLen
+					}
+				}
+			}
+		}
+		result = append(result, u)
+	}
+	return result
 }
 
-// The main event loop receives messages from gNMI, validates them and then dispatches them.
-func eventLoop(ctx context.Context, client pb.GNMIClient,
-	respChan chan *pb.SubscribeResponse, errChan chan error) error {
+// The main event loop receives messages (tagged with the target they came from) from either a
+// dial-in subscription or a dial-out server, parses each Notification against the YANG schema and
+// dispatches it to the relevant interface state machine's own goroutine via mgr.
+func eventLoop(mgr *Manager, msgChan chan *message, errChan chan error) error {
 	// Loop forever
 	for {
 		// Read either from responses or error channel (whichever is ready first)
 		select {
-		case resp := <-respChan:
+		case msg := <-msgChan:
 			// Check the type of response.
-			switch resp := resp.Response.(type) {
+			switch resp := msg.resp.Response.(type) {
 			case *pb.SubscribeResponse_Error:
 				return errors.New(resp.Error.Message)
 			case *pb.SubscribeResponse_SyncResponse:
 				// This message indicates that the initial state for the subscribed paths has been
-				// completely streamed out. We don't need to differentiate between initial state
-				// and on-going updates in our program.
+				// completely streamed out. Once it's in, the target's allocator can start handing
+				// out freshly-assigned (rather than only restored) leases.
 				if !resp.SyncResponse {
 					return errors.New("initial sync failed")
 				}
+				mgr.allocatorFor(msg.target).MarkSynced()
+				// Give every interface of this target another pass through configured(), so the
+				// ones whose IP assignment was deferred until now get their fresh lease.
+				mgr.mu.Lock()
+				var ifaces []string
+				for key := range mgr.sms {
+					if key.target == msg.target {
+						ifaces = append(ifaces, key.iface)
+					}
+				}
+				mgr.mu.Unlock()
+				for _, iface := range ifaces {
+					mgr.dispatch(msg.target, iface, smEvent{reconfigure: true})
+				}
 			case *pb.SubscribeResponse_Update:
-				// This is the common path prefix for all updates in this message.
-				// We use StrPath function to transform the path components into a slash delimited
-				// string. This is fine for our examples, but in a real system you probably want to
-				// parse and validate these paths (with something like goyang).
-				prefix := gnmi.StrPath(resp.Update.Prefix)
-				// We're looping over Updates. In this example, we don't look at the Delete field
-				// of the response (which would indicate that the IP address was deconfigured, for
-				// instance).
-				for _, update := range resp.Update.Update {
-					// Build the absolute path
-					path := path.Join(prefix, gnmi.StrPath(update.Path))
-					// Get the value at this path as a string.
-					// Values can be encoded in different ways in gNMI but StrUpdateVale takes care
-					// of that for us.
-					value := gnmi.StrUpdateVal(update)
-					glog.V(5).Infof("Received update for path %s value %s", path, value)
-
-					event := getEvent(path)
-
-					glog.V(5).Infof("Dispatching event %#v", event)
-					dispatchEvent(ctx, client, event, value)
+				for _, u := range parseNotification(resp.Update, msg.target) {
+					glog.V(5).Infof("Dispatching update %#v", u)
+					mgr.dispatch(u.target, u.iface, smEvent{update: u})
 				}
 			}
 		case err := <-errChan:
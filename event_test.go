@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aristanetworks/goarista/gnmi"
+	pb "github.com/openconfig/gnmi/proto/gnmi"
+
+	"github.com/wladh/inogf/oc"
+)
+
+func mustParsePath(t *testing.T, path string) *pb.Path {
+	t.Helper()
+	p, err := gnmi.ParseGNMIElements(gnmi.SplitPath(path))
+	if err != nil {
+		t.Fatalf("parsing path %s: %v", path, err)
+	}
+	return p
+}
+
+func strUpdate(t *testing.T, path, value string) *pb.Update {
+	t.Helper()
+	return &pb.Update{
+		Path: mustParsePath(t, path),
+		Val:  &pb.TypedValue{Value: &pb.TypedValue_StringVal{StringVal: value}},
+	}
+}
+
+// TestParseNotification exercises parseNotification against the exact paths inogf subscribes to
+// (adminStatusPath and ipv4AddressPath in main.go), rather than a hand-picked shape: this is what
+// would have caught the ipv4/addresses schema mismatch immediately instead of silently dropping
+// every ipv4 update.
+func TestParseNotification(t *testing.T) {
+	if err := loadSchema(); err != nil {
+		t.Fatalf("loadSchema: %v", err)
+	}
+
+	n := &pb.Notification{
+		Prefix: mustParsePath(t, "/interfaces/interface[name=Ethernet1]/subinterfaces/subinterface[index=0]"),
+		Update: []*pb.Update{
+			strUpdate(t, "/ipv4/addresses/address[ip=10.0.1.1]/state/ip", "10.0.1.1"),
+			strUpdate(t, "/ipv4/addresses/address[ip=10.0.1.1]/state/prefix-length", "24"),
+		},
+	}
+
+	updates := parseNotification(n, "dut1")
+	if len(updates) != 1 {
+		t.Fatalf("got %d updates, want 1: %#v", len(updates), updates)
+	}
+
+	u := updates[0]
+	if u.target != "dut1" || u.iface != "Ethernet1" || u.subIndex != 0 {
+		t.Errorf("got target=%s iface=%s subIndex=%d, want dut1/Ethernet1/0", u.target, u.iface, u.subIndex)
+	}
+	if u.prefix == nil || *u.prefix != "10.0.1.1" {
+		t.Errorf("got prefix=%v, want 10.0.1.1", u.prefix)
+	}
+	if u.prefixLen == nil || *u.prefixLen != 24 {
+		t.Errorf("got prefixLen=%v, want 24", u.prefixLen)
+	}
+}
+
+func TestParseNotificationAdminStatus(t *testing.T) {
+	if err := loadSchema(); err != nil {
+		t.Fatalf("loadSchema: %v", err)
+	}
+
+	cases := []struct {
+		name  string
+		value string
+		want  oc.AdminStatus
+	}{
+		{"up", "UP", oc.AdminStatus_UP},
+		{"down", "DOWN", oc.AdminStatus_DOWN},
+		{"unrecognized", "TESTING", oc.AdminStatus_UNSET},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			n := &pb.Notification{
+				Update: []*pb.Update{
+					strUpdate(t, "/interfaces/interface[name=Ethernet1]/state/admin-status", c.value),
+				},
+			}
+			updates := parseNotification(n, "dut1")
+			if len(updates) != 1 {
+				t.Fatalf("got %d updates, want 1: %#v", len(updates), updates)
+			}
+			if got := updates[0].adminStatus; got != c.want {
+				t.Errorf("got adminStatus=%v, want %v", got, c.want)
+			}
+		})
+	}
+}
@@ -1,18 +1,35 @@
 package main
 
 import (
-	"context"
-	"strconv"
 	"sync"
-	"time"
 
 	"github.com/aristanetworks/glog"
 
-	pb "github.com/openconfig/gnmi/proto/gnmi"
+	"github.com/wladh/inogf/oc"
 )
 
-// A global map from interface name to its state machine object.
-var interfaces = make(map[string]*interfaceSm)
+// smKey identifies a state machine: the target device and the interface name on that device.
+// Dial-out mode can be feeding us notifications from many devices at once, so the interface name
+// alone is no longer enough to tell state machines apart.
+type smKey struct {
+	target string
+	iface  string
+}
+
+// smEvent is the only thing ever sent on an interfaceSm's events channel. update carries a
+// gNMI-driven state change; reconfigure instead asks the state machine to re-run configured()
+// against its allocator's current pools, which a config reload uses to push out a changed
+// prefix length without pretending the device itself sent us anything new, and which the first
+// gNMI sync uses to assign the IPs that were deferred until it arrived.
+type smEvent struct {
+	update      *ifUpdate
+	reconfigure bool
+}
+
+// smEventQueueDepth bounds how many events can be queued for a single interface before dispatch
+// blocks. A blocked dispatch applies back-pressure to the (single) eventLoop goroutine reading
+// off the gNMI stream, which is preferable to an unbounded queue hiding a stuck state machine.
+const smEventQueueDepth = 16
 
 // State machine states.
 const (
@@ -38,43 +55,48 @@ func stateName(state int) string {
 }
 
 // Interface state machine.
-// Each interface will have its own instance of the state machine.
+// Each (target, interface) pair has its own instance of the state machine, with its own
+// goroutine draining events off its own channel, so no two goroutines ever touch one interfaceSm's
+// fields at once and it needs no mutex of its own.
 type interfaceSm struct {
 	state     int
+	target    string
 	name      string
 	prefix    string
 	prefixLen int
 
-	// Timer for waiting on receiving the current configuration from interface.
-	// Since the messages from gNMI arrive asynchronously we can't know in advance if we got all
-	// the information we needed, so we wait for a while.
-	timer *time.Timer
-
-	// A lock to make event handling thread-safe. While the event loop is single threaded,
-	// the timer will be fired from another thread.
-	// A better design would be to have the timer generate an event into the event loop,
-	// but I wanted to keep the code simple and not use additional channels.
-	mu sync.Mutex
-
-	// Client and context needed to communicate with gNMI server.
-	// In a better design these would be part of a state machines manager.
-	ctx    context.Context
-	client pb.GNMIClient
+	// mgr gives the state machine access to the gNMI context/client and the IP allocator for its
+	// target, without each interfaceSm needing its own copies.
+	mgr    *Manager
+	events chan smEvent
 }
 
-// Retrieves or creates the state machine for the given interface.
-func getInterfaceSm(ctx context.Context, client pb.GNMIClient, iface string) *interfaceSm {
-	sm, ok := interfaces[iface]
-	if !ok {
-		sm = &interfaceSm{
-			name:   iface,
-			ctx:    ctx,
-			client: client,
-		}
-		interfaces[iface] = sm
+// newInterfaceSm creates a state machine for target/iface. It doesn't start the goroutine that
+// drains its events channel; call run for that (Manager.smFor does both).
+func newInterfaceSm(mgr *Manager, target, iface string) *interfaceSm {
+	return &interfaceSm{
+		target: target,
+		name:   iface,
+		mgr:    mgr,
+		events: make(chan smEvent, smEventQueueDepth),
 	}
+}
 
-	return sm
+// run is the state machine's event loop: it applies events one at a time, in the order they were
+// dispatched, until its events channel is closed by Manager.Shutdown.
+func (sm *interfaceSm) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for ev := range sm.events {
+		if ev.reconfigure {
+			// Only meaningful once the interface has a configuration to reconcile; applying it
+			// before then would just re-derive the same "still waiting" outcome.
+			if sm.state == configured {
+				sm.configured()
+			}
+			continue
+		}
+		sm.applyUpdate(ev.update)
+	}
 }
 
 // This function returns true if the state machine has all the information needed to configure the
@@ -83,26 +105,16 @@ func (sm *interfaceSm) configComplete() bool {
 	return sm.prefix != "" && sm.prefixLen > 0
 }
 
-// Transition the state machine to "adminDown" state. We cancel the configuration receive timer and
-// release its IP.
+// Transition the state machine to "adminDown" state and start its IP's lease TTL.
 func (sm *interfaceSm) adminDown() {
 	sm.state = adminDown
 
-	if sm.timer != nil {
-		sm.timer.Stop()
-	}
-	ipDB.releaseIP(sm.prefix)
+	sm.mgr.allocatorFor(sm.target).ReleaseIP(sm.name)
 }
 
-// Transition the state machine to "adminUp" state. If we didn't receive the complete interface
-// configuration, start a timer to wait for it.
+// Transition the state machine to "adminUp" state.
 func (sm *interfaceSm) adminUp() {
 	sm.state = adminUp
-
-	// If we don't have the configuration yet, start a 20 seconds timer.
-	if !sm.configComplete() {
-		sm.timer = time.AfterFunc(20*time.Second, sm.timerEventHandler)
-	}
 }
 
 // Transition the state machine to "configured" state. If we received configuration for this
@@ -111,126 +123,81 @@ func (sm *interfaceSm) adminUp() {
 func (sm *interfaceSm) configured() {
 	sm.state = configured
 
+	db := sm.mgr.allocatorFor(sm.target)
 	if sm.configComplete() {
 		// If we already have the interface's configuration, try to reconcile it.
 		var ok bool
-		if sm.prefix, sm.prefixLen, ok = ipDB.reconcile(sm.name, sm.prefix, sm.prefixLen); ok {
+		if sm.prefix, sm.prefixLen, ok = db.Reconcile(sm.name, sm.prefix, sm.prefixLen); ok {
 			// If it was successfully reconciled, there's nothing more to do, as we keep the
 			// current configuration.
-			glog.V(5).Infof("Prefix %s/%d reconciled for %s", sm.prefix, sm.prefixLen, sm.name)
+			glog.V(5).Infof("Prefix %s/%d reconciled for %s on %s", sm.prefix, sm.prefixLen, sm.name, sm.target)
 			return
 		}
 	} else {
-		// If the interface doesn't have any IP address configured, assign it a new one.
-		sm.prefix, sm.prefixLen = ipDB.getIP(sm.name)
+		// If the interface doesn't have any IP address configured, assign it a new one. This can
+		// come back !ok if the pool is exhausted, or if we're still waiting for the first gNMI
+		// sync to complete before handing out fresh (as opposed to restored) leases.
+		prefix, prefixLen, ok := db.GetIP(sm.name)
+		if !ok {
+			glog.V(5).Infof("Deferring IP assignment for %s on %s", sm.name, sm.target)
+			return
+		}
+		sm.prefix, sm.prefixLen = prefix, prefixLen
 	}
 
-	glog.V(5).Infof("Setting prefix %s/%d for %s", sm.prefix, sm.prefixLen, sm.name)
+	glog.V(5).Infof("Setting prefix %s/%d for %s on %s", sm.prefix, sm.prefixLen, sm.name, sm.target)
 
 	// If we're here, it means we need to reconfigure the interface.
-	if err := setPrefix(sm.ctx, sm.client, sm.name, sm.prefix, sm.prefixLen); err != nil {
-		glog.Errorf("Error setting prefix %s/%d for %s: %v", sm.prefix, sm.prefixLen, sm.name, err)
+	client, err := sm.mgr.clientFor(sm.target)
+	if err != nil {
+		glog.Errorf("Unable to get gNMI client for %s: %v", sm.target, err)
+		return
 	}
-}
-
-// Event handler for "adminStatus" events.
-// If the event's value is "UP", transition the machine to "adminUp", and if we received the
-// configuration for the interface, transition it further to "configured".
-func (sm *interfaceSm) adminStatusEventHandler(ev *event, value string) {
-	// Since the event handlers can be called from multiple threads (timer and event loop),
-	// we need to lock the object while we perform our operations.
-	sm.mu.Lock()
-	// Unlock when we're returning from this function.
-	defer sm.mu.Unlock()
-
-	glog.V(5).Infof("Handling adminStatus %s for %s", value, sm.name)
-
-	switch value {
-	case "UP":
-		if sm.state > adminDown {
-			return
-		}
-
-		sm.adminUp()
-
-		if sm.configComplete() {
-			sm.configured()
-		}
-	case "DOWN":
-		sm.adminDown()
-	default:
-		glog.Errorf("Unknown admin state: %s", value)
+	if err := setPrefix(sm.mgr.ctx, client, sm.name, sm.prefix, sm.prefixLen); err != nil {
+		glog.Errorf("Error setting prefix %s/%d for %s on %s: %v",
+			sm.prefix, sm.prefixLen, sm.name, sm.target, err)
 	}
-
-	glog.V(5).Infof("New state for %s: %s", sm.name, stateName(sm.state))
 }
 
-// Event handler for "prefixEvent".
-// We store the value and if the state machine is in "adminUp" state, and we received all the
-// configuration we transition to "configured" state.
-// Otherwise we do nothing.
-func (sm *interfaceSm) prefixEventHandler(ev *event, value string) {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
-	glog.V(5).Infof("Handling prefix %s for %s", value, sm.name)
-
-	sm.prefix = value
-
-	if sm.state != adminUp {
+// applyUpdate replaces the old per-leaf event handlers (adminStatusEventHandler,
+// prefixEventHandler, prefixLenEventHandler and the timer that used to wait for them to all
+// arrive): since parseNotification already batches every leaf a Notification carried for this
+// interface into a single ifUpdate, we can apply it atomically and decide the resulting
+// transition in one pass, instead of waiting to see whether more leaves show up later.
+func (sm *interfaceSm) applyUpdate(u *ifUpdate) {
+	glog.V(5).Infof("Applying update for %s on %s: %#v", sm.name, sm.target, u)
+
+	if u.prefixDeleted {
+		// Losing the configured address takes the interface back down from our point of view:
+		// there's nothing to reconcile until it's reconfigured or a new one is assigned.
+		sm.adminDown()
+		sm.prefix = ""
+		sm.prefixLen = 0
+		glog.V(5).Infof("New state for %s: %s", sm.name, stateName(sm.state))
 		return
 	}
 
-	if sm.configComplete() {
-		sm.configured()
+	if u.prefix != nil {
+		sm.prefix = *u.prefix
 	}
-
-	glog.V(5).Infof("New state for %s: %s", sm.name, stateName(sm.state))
-}
-
-// Event handler for "prefixLenEvent".
-// We store the value and if the state machine is in "adminUp" state, and we received all the
-// configuration we transition to "configured" state.
-// Otherwise we do nothing.
-func (sm *interfaceSm) prefixLenEventHandler(ev *event, value string) {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
-	glog.V(5).Infof("Handling prefix length %s for %s", value, sm.name)
-
-	// Convert the value from string to integer.
-	prefixLen, err := strconv.Atoi(value)
-	if err != nil {
-		glog.Errorf("Invalid prefix len: %s", value)
+	if u.prefixLen != nil {
+		sm.prefixLen = *u.prefixLen
 	}
-	sm.prefixLen = prefixLen
 
-	if sm.state != adminUp {
-		return
+	switch u.adminStatus {
+	case oc.AdminStatus_UP:
+		if sm.state <= adminDown {
+			sm.adminUp()
+		}
+	case oc.AdminStatus_DOWN:
+		sm.adminDown()
+	case oc.AdminStatus_UNSET:
+		// This notification didn't carry an admin-status leaf; keep the current state.
 	}
 
-	if sm.configComplete() {
+	if sm.state == adminUp {
 		sm.configured()
 	}
 
 	glog.V(5).Infof("New state for %s: %s", sm.name, stateName(sm.state))
 }
-
-// We handle the "timerEvent".
-// If the state machine is in "adminUp", we transition it to "configured" state.
-// Otherwise we do nothing.
-func (sm *interfaceSm) timerEventHandler() {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
-	glog.V(5).Infof("Handling timer for %s", sm.name)
-
-	if sm.state != adminUp {
-		return
-	}
-	sm.timer = nil
-
-	sm.configured()
-
-	glog.V(5).Infof("New state for %s: %s", sm.name, stateName(sm.state))
-}
@@ -1,82 +1,378 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"regexp"
+	"sync"
+	"time"
 
 	"github.com/aristanetworks/glog"
 )
 
-// A global variable that holds our IP DB.
-var ipDB ipDBManager
-
-// A dumb demo IP database that holds a fixed number of IPs with a fixed prefix length.
-type ipDBManager struct {
-	// A map from IP to the interface it's assigned to.
-	// An empty string value means "not assigned".
-	ips map[string]string
-	// A map from interface to its assigned IP.
-	// Entries exist only for interfaces that have assigned IPs.
-	interfaces map[string]string
-	// The prefix length for IPs.
+// poolState is a Pool with its regex compiled and its addresses tracked as a map from IP to the
+// interface currently leasing it ("" meaning free).
+type poolState struct {
+	name      string
+	re        *regexp.Regexp
 	prefixLen int
+	ips       map[string]string
+
+	// draining is set on a pool that was removed from the configuration by a reload: it keeps
+	// serving the leases it already handed out, but poolFor skips it for new assignments.
+	draining bool
+}
+
+// lease is one interface's currently assigned (or recently released) address.
+type lease struct {
+	ip        string
+	prefixLen int
+	pool      *poolState
+	// releaseAt is when the lease's IP should be returned to its pool. The zero Time means the
+	// lease is currently held (the interface hasn't gone adminDown).
+	releaseAt time.Time
+}
+
+// memAllocator is the in-memory IPAllocator implementation: simple, but its leases don't survive
+// a restart. See newBoltAllocator for a persistent one.
+type memAllocator struct {
+	mu       sync.Mutex
+	pools    []*poolState
+	leases   map[string]*lease
+	leaseTTL time.Duration
+	synced   bool
+
+	// onChange, if set, is called after every mutation (including leases expiring via
+	// sweepLoop). Persistent backends use it to write a fresh snapshot back to disk.
+	onChange func()
+}
+
+// newMemAllocator creates an allocator over the given pools and starts the background sweep
+// that returns expired leases to their pool.
+func newMemAllocator(pools []Pool, leaseTTL time.Duration) (*memAllocator, error) {
+	states, err := newPoolStates(pools)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &memAllocator{pools: states, leases: make(map[string]*lease), leaseTTL: leaseTTL}
+	go a.sweepLoop()
+	return a, nil
+}
+
+func newPoolStates(pools []Pool) ([]*poolState, error) {
+	states := make([]*poolState, 0, len(pools))
+	for _, p := range pools {
+		re, err := regexp.Compile(p.IfaceRegex)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := generateIPs(p.CIDR)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, &poolState{name: p.Name, re: re, prefixLen: p.PrefixLen, ips: ips})
+	}
+	return states, nil
+}
+
+// poolFor returns the first non-draining pool whose regex matches iface, or nil.
+func (a *memAllocator) poolFor(iface string) *poolState {
+	for _, p := range a.pools {
+		if !p.draining && p.re.MatchString(iface) {
+			return p
+		}
+	}
+	return nil
+}
+
+func (a *memAllocator) poolByName(name string) *poolState {
+	for _, p := range a.pools {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// sweepLoop periodically returns expired leases to their pool. A real system would probably use
+// one timer per lease; a single periodic scan is simpler and plenty for the lease counts inogf
+// deals with.
+func (a *memAllocator) sweepLoop() {
+	tick := time.Second
+	if a.leaseTTL > 0 && a.leaseTTL/4 > tick {
+		tick = a.leaseTTL / 4
+	}
+	for range time.Tick(tick) {
+		a.sweep(time.Now())
+	}
+}
+
+// notify invokes onChange, if set. Must be called without a.mu held.
+func (a *memAllocator) notify() {
+	if a.onChange != nil {
+		a.onChange()
+	}
+}
+
+func (a *memAllocator) sweep(now time.Time) {
+	a.mu.Lock()
+	changed := false
+	for iface, l := range a.leases {
+		if !l.releaseAt.IsZero() && !now.Before(l.releaseAt) {
+			l.pool.ips[l.ip] = ""
+			delete(a.leases, iface)
+			glog.V(5).Infof("Lease for %s (%s) expired, returned to pool %s", iface, l.ip, l.pool.name)
+			changed = true
+		}
+	}
+	if changed {
+		a.pools = dropDrainedPools(a.pools, a.leases)
+	}
+	a.mu.Unlock()
+
+	if changed {
+		a.notify()
+	}
+}
+
+// dropDrainedPools removes draining pools that no longer back any lease, so a reload that
+// removes a pool doesn't leak its poolState forever once its last lease expires.
+func dropDrainedPools(pools []*poolState, leases map[string]*lease) []*poolState {
+	inUse := make(map[*poolState]bool, len(leases))
+	for _, l := range leases {
+		inUse[l.pool] = true
+	}
+
+	kept := pools[:0]
+	for _, p := range pools {
+		if p.draining && !inUse[p] {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return kept
 }
 
-// Adds "n" IP addresses (of the form "10.0.<i>.1") to the database and sets the prefix length.
-func initIPs(n int, prefixLen int) {
-	ipDB.ips = make(map[string]string)
-	ipDB.interfaces = make(map[string]string)
-	ipDB.prefixLen = prefixLen
+func (a *memAllocator) GetIP(iface string) (string, int, bool) {
+	a.mu.Lock()
+
+	if l, ok := a.leases[iface]; ok {
+		l.releaseAt = time.Time{}
+		ip, prefixLen := l.ip, l.prefixLen
+		a.mu.Unlock()
+		a.notify()
+		return ip, prefixLen, true
+	}
+	if !a.synced {
+		a.mu.Unlock()
+		return "", 0, false
+	}
 
-	for i := 1; i <= n; i++ {
-		k := fmt.Sprintf("10.0.%d.1", i)
-		ipDB.ips[k] = ""
+	pool := a.poolFor(iface)
+	if pool == nil {
+		a.mu.Unlock()
+		glog.Errorf("No IP pool configured for interface %s", iface)
+		return "", 0, false
 	}
+	for ip, owner := range pool.ips {
+		if owner == "" {
+			pool.ips[ip] = iface
+			a.leases[iface] = &lease{ip: ip, prefixLen: pool.prefixLen, pool: pool}
+			a.mu.Unlock()
+			a.notify()
+			return ip, pool.prefixLen, true
+		}
+	}
+	a.mu.Unlock()
+	glog.Errorf("IP addresses exhausted in pool %s", pool.name)
+	return "", 0, false
+}
+
+func (a *memAllocator) Reconcile(iface, ip string, prefixLen int) (string, int, bool) {
+	a.mu.Lock()
+	if l, ok := a.leases[iface]; ok && l.ip == ip {
+		l.releaseAt = time.Time{}
+		consistent := prefixLen == l.prefixLen
+		a.mu.Unlock()
+		a.notify()
+		return l.ip, l.prefixLen, consistent
+	}
+
+	// Try to keep the given IP if it belongs to a pool this interface matches and isn't leased
+	// to someone else.
+	if pool := a.poolFor(iface); pool != nil {
+		if owner, ok := pool.ips[ip]; ok && (owner == "" || owner == iface) {
+			pool.ips[ip] = iface
+			a.leases[iface] = &lease{ip: ip, prefixLen: pool.prefixLen, pool: pool}
+			a.mu.Unlock()
+			a.notify()
+			return ip, pool.prefixLen, prefixLen == pool.prefixLen
+		}
+	}
+	a.mu.Unlock()
+
+	// Otherwise, assign a new one. GetIP takes care of its own notify().
+	newIP, newLen, ok := a.GetIP(iface)
+	if !ok {
+		// Couldn't assign a replacement (pool exhausted, or still waiting on the initial sync):
+		// keep reporting the interface's current configuration rather than losing it outright.
+		return ip, prefixLen, false
+	}
+	return newIP, newLen, false
+}
+
+func (a *memAllocator) ReleaseIP(iface string) {
+	a.mu.Lock()
+	l, ok := a.leases[iface]
+	if ok {
+		l.releaseAt = time.Now().Add(a.leaseTTL)
+	}
+	a.mu.Unlock()
+
+	if ok {
+		a.notify()
+	}
+}
+
+func (a *memAllocator) MarkSynced() {
+	a.mu.Lock()
+	a.synced = true
+	a.mu.Unlock()
 }
 
-// Gets the IP for the interface.
-// If the interface already has an IP assigned, it will return it. Otherwise, it will assign it
-// a new one.
-func (db *ipDBManager) getIP(iface string) (string, int) {
-	if addr, ok := db.interfaces[iface]; ok {
-		return addr, db.prefixLen
+func (a *memAllocator) Reconfigure(pools []Pool, leaseTTL time.Duration) ([]string, error) {
+	updated, err := newPoolStates(pools)
+	if err != nil {
+		return nil, err
+	}
+	updatedByName := make(map[string]*poolState, len(updated))
+	for _, p := range updated {
+		updatedByName[p.name] = p
 	}
 
-	for k, v := range db.ips {
-		if v == "" {
-			db.ips[k] = iface
-			db.interfaces[iface] = k
-			return k, db.prefixLen
+	a.mu.Lock()
+	a.leaseTTL = leaseTTL
+
+	next := make([]*poolState, 0, len(a.pools)+len(updated))
+	seen := make(map[string]bool, len(a.pools))
+	var affected []string
+
+	for _, old := range a.pools {
+		seen[old.name] = true
+
+		p, ok := updatedByName[old.name]
+		if !ok {
+			// Removed from the config: stop handing out new addresses from it, but let its
+			// current leases run their course rather than yanking addresses out from under
+			// configured interfaces.
+			old.draining = true
+			next = append(next, old)
+			continue
 		}
+
+		// Keep the existing address ownership map rather than the fresh, all-free one
+		// newPoolStates just generated for it: that's what lets current leases survive a
+		// reload instead of looking like they'd all gone stale.
+		p.ips = old.ips
+		if p.prefixLen != old.prefixLen {
+			for iface, l := range a.leases {
+				if l.pool == old {
+					affected = append(affected, iface)
+				}
+			}
+		}
+		for _, l := range a.leases {
+			if l.pool == old {
+				l.pool = p
+				l.prefixLen = p.prefixLen
+			}
+		}
+		next = append(next, p)
 	}
-	glog.Error("IP addresses exhausted")
+	for _, p := range updated {
+		if !seen[p.name] {
+			next = append(next, p)
+		}
+	}
+
+	a.pools = next
+	a.mu.Unlock()
 
-	return "1.1.1.1", 32
+	a.notify()
+	return affected, nil
 }
 
-// Reconciles the IP and prefix length for the specified interface with the database.
-// It returns an IP, prefix length, and whether the given IP and prefix length are consistent with
-// the database (ie, interface doesn't need to be reconfigured).
-// Reconciliation is needed because we don't want to needlessly reconfigure an interface
-// that already has its assigned address already configured, or its configured address is not
-// currently allocated to another interface.
-func (db *ipDBManager) reconcile(iface string, ip string, prefixLen int) (string, int, bool) {
-	// Try to keep the given IP and prefix length if possible (ie, if not assigned or assigned to
-	// the same inteface).
-	if v, ok := db.ips[ip]; ok && (v == "" || v == iface) {
-		db.ips[ip] = iface
-		db.interfaces[iface] = ip
-		return ip, db.prefixLen, prefixLen == db.prefixLen
+// leaseRecord is the serialized form of a lease, used by Snapshot/Restore.
+type leaseRecord struct {
+	Iface     string    `json:"iface"`
+	IP        string    `json:"ip"`
+	PrefixLen int       `json:"prefix_len"`
+	Pool      string    `json:"pool"`
+	ReleaseAt time.Time `json:"release_at,omitempty"`
+}
+
+func (a *memAllocator) Snapshot() ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	records := make([]leaseRecord, 0, len(a.leases))
+	for iface, l := range a.leases {
+		records = append(records, leaseRecord{
+			Iface: iface, IP: l.ip, PrefixLen: l.prefixLen, Pool: l.pool.name, ReleaseAt: l.releaseAt,
+		})
+	}
+	return json.Marshal(records)
+}
+
+func (a *memAllocator) Restore(data []byte) error {
+	var records []leaseRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return err
 	}
-	// Otherwise, assign a new one.
-	ip, prefixLen = db.getIP(iface)
-	return ip, prefixLen, false
 
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, r := range records {
+		pool := a.poolByName(r.Pool)
+		if pool == nil {
+			glog.Errorf("Restoring lease for %s: unknown pool %q, dropping", r.Iface, r.Pool)
+			continue
+		}
+		pool.ips[r.IP] = r.Iface
+		a.leases[r.Iface] = &lease{ip: r.IP, prefixLen: r.PrefixLen, pool: pool, releaseAt: r.ReleaseAt}
+	}
+	return nil
 }
 
-// Marks the IP as unassigned.
-func (db *ipDBManager) releaseIP(ip string) {
-	if iface, ok := db.ips[ip]; ok {
-		delete(db.interfaces, iface)
+// allocatorFactory returns the per-target allocator constructor for the named backend:
+// "memory" (lost on restart), "bolt" (persisted to ipdbFile) or "etcd" (persisted to an etcd
+// cluster, only available when built with -tags etcd). Pools and the lease TTL are passed in at
+// call time, rather than baked in here, so that Manager can build a target's first allocator
+// straight from whatever Config a reload last landed. For "bolt", the backing *bolt.DB is opened
+// once, here, and shared by every target's constructor: bolt.Open takes an exclusive flock on
+// ipdbFile, so opening it again per target would deadlock the second target seen.
+func allocatorFactory(backend, ipdbFile string,
+	etcdEndpoints []string) (func(target string, pools []Pool, leaseTTL time.Duration) (IPAllocator, error), error) {
+	switch backend {
+	case "memory":
+		return func(target string, pools []Pool, leaseTTL time.Duration) (IPAllocator, error) {
+			return newMemAllocator(pools, leaseTTL)
+		}, nil
+	case "bolt":
+		db, err := openBoltDB(ipdbFile)
+		if err != nil {
+			return nil, fmt.Errorf("opening %s: %w", ipdbFile, err)
+		}
+		return func(target string, pools []Pool, leaseTTL time.Duration) (IPAllocator, error) {
+			return newBoltAllocator(db, target, pools, leaseTTL)
+		}, nil
+	case "etcd":
+		return func(target string, pools []Pool, leaseTTL time.Duration) (IPAllocator, error) {
+			return newEtcdAllocator(etcdEndpoints, target, pools, leaseTTL)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown IP allocator backend %q", backend)
 	}
-	db.ips[ip] = ""
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aristanetworks/glog"
+	bolt "go.etcd.io/bbolt"
+)
+
+// leasesBucket holds one key per target, whose value is that target's memAllocator.Snapshot().
+var leasesBucket = []byte("leases")
+
+// openBoltDB opens (creating if necessary) the BoltDB file at path and its leasesBucket. bolt.Open
+// takes a blocking, exclusive flock on the file, so this must be called once per path and the
+// resulting handle shared across every target's newBoltAllocator call; a second Open on the same
+// path from this process would simply hang waiting for a lock it already holds.
+func openBoltDB(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(leasesBucket)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// newBoltAllocator restores target's persisted leases (if any) from db into a memAllocator, and
+// wires it up so every subsequent mutation is written straight back to the same key. db is shared
+// across every target backed by the same -ipdb-file, so this must never call bolt.Open itself.
+func newBoltAllocator(db *bolt.DB, target string, pools []Pool, leaseTTL time.Duration) (IPAllocator, error) {
+	mem, err := newMemAllocator(pools, leaseTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(leasesBucket).Get([]byte(target)); data != nil {
+			return mem.Restore(data)
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("restoring leases for %s: %w", target, err)
+	}
+
+	mem.onChange = func() {
+		data, err := mem.Snapshot()
+		if err != nil {
+			glog.Errorf("Snapshotting leases for %s: %v", target, err)
+			return
+		}
+		if err := db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(leasesBucket).Put([]byte(target), data)
+		}); err != nil {
+			glog.Errorf("Persisting leases for %s: %v", target, err)
+		}
+	}
+
+	return mem, nil
+}
@@ -0,0 +1,59 @@
+//go:build etcd
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aristanetworks/glog"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// etcdKeyPrefix namespaces the leases this program writes, so several inogf instances (or other
+// applications) can share an etcd cluster.
+const etcdKeyPrefix = "/inogf/leases/"
+
+// newEtcdAllocator restores target's persisted leases from etcd and wires up a memAllocator so
+// every subsequent mutation is written straight back to its key. Only built with `-tags etcd`,
+// since most deployments will be happy with the default BoltDB-backed allocator.
+func newEtcdAllocator(endpoints []string, target string, pools []Pool, leaseTTL time.Duration) (IPAllocator, error) {
+	cli, err := clientv3.New(clientv3.Config{Endpoints: endpoints, DialTimeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	mem, err := newMemAllocator(pools, leaseTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	key := etcdKeyPrefix + target
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	resp, err := cli.Get(ctx, key)
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("reading leases for %s: %w", target, err)
+	}
+	if len(resp.Kvs) > 0 {
+		if err := mem.Restore(resp.Kvs[0].Value); err != nil {
+			return nil, fmt.Errorf("restoring leases for %s: %w", target, err)
+		}
+	}
+
+	mem.onChange = func() {
+		data, err := mem.Snapshot()
+		if err != nil {
+			glog.Errorf("Snapshotting leases for %s: %v", target, err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := cli.Put(ctx, key, string(data)); err != nil {
+			glog.Errorf("Persisting leases for %s: %v", target, err)
+		}
+	}
+
+	return mem, nil
+}
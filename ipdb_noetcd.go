@@ -0,0 +1,14 @@
+//go:build !etcd
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// newEtcdAllocator is a stub used when inogf is built without the etcd driver (the default).
+// Build with `-tags etcd` to get the real implementation in ipdb_etcd.go.
+func newEtcdAllocator(endpoints []string, target string, pools []Pool, leaseTTL time.Duration) (IPAllocator, error) {
+	return nil, fmt.Errorf("inogf was built without etcd support: rebuild with -tags etcd to use -backend=etcd")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGenerateIPs(t *testing.T) {
+	cases := []struct {
+		name    string
+		cidr    string
+		count   int
+		wantIn  []string
+		wantNot []string
+	}{
+		{
+			name:   "/16 default pool",
+			cidr:   "10.0.0.0/16",
+			count:  254,
+			wantIn: []string{"10.0.1.1"},
+		},
+		{
+			name:   "/24 pool",
+			cidr:   "10.0.5.0/24",
+			count:  1,
+			wantIn: []string{"10.0.5.1"},
+		},
+		{
+			name:    "/17 pool",
+			cidr:    "10.0.128.0/17",
+			count:   128,
+			wantIn:  []string{"10.0.128.1", "10.0.255.1"},
+			wantNot: []string{"10.0.1.1", "10.0.127.1"},
+		},
+		{
+			name:    "pool smaller than /24",
+			cidr:    "10.0.5.128/25",
+			count:   1,
+			wantIn:  []string{"10.0.5.129"},
+			wantNot: []string{"10.0.5.1", "10.0.1.1"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ips, err := generateIPs(c.cidr)
+			if err != nil {
+				t.Fatalf("generateIPs(%s): %v", c.cidr, err)
+			}
+			if len(ips) != c.count {
+				t.Errorf("got %d addresses, want %d", len(ips), c.count)
+			}
+			for _, ip := range c.wantIn {
+				if _, ok := ips[ip]; !ok {
+					t.Errorf("expected %s in pool for %s, got %v", ip, c.cidr, ips)
+				}
+			}
+			for _, ip := range c.wantNot {
+				if _, ok := ips[ip]; ok {
+					t.Errorf("did not expect %s in pool for %s", ip, c.cidr)
+				}
+			}
+		})
+	}
+}
+
+func TestMemAllocatorLeaseLifecycle(t *testing.T) {
+	pools := []Pool{{Name: "p1", CIDR: "10.0.5.0/24", IfaceRegex: "Ethernet.*", PrefixLen: 24}}
+	leaseTTL := 10 * time.Millisecond
+
+	a, err := newMemAllocator(pools, leaseTTL)
+	if err != nil {
+		t.Fatalf("newMemAllocator: %v", err)
+	}
+	a.MarkSynced()
+
+	ip, prefixLen, ok := a.GetIP("Ethernet1")
+	if !ok || ip != "10.0.5.1" || prefixLen != 24 {
+		t.Fatalf("got ip=%s prefixLen=%d ok=%v, want 10.0.5.1/24/true", ip, prefixLen, ok)
+	}
+
+	// Releasing doesn't free the lease immediately; it's only eligible once leaseTTL has passed.
+	a.ReleaseIP("Ethernet1")
+	a.sweep(time.Now())
+	a.mu.Lock()
+	_, stillLeased := a.leases["Ethernet1"]
+	a.mu.Unlock()
+	if !stillLeased {
+		t.Fatalf("lease was freed before its TTL elapsed")
+	}
+
+	a.sweep(time.Now().Add(leaseTTL))
+	a.mu.Lock()
+	_, stillLeased = a.leases["Ethernet1"]
+	a.mu.Unlock()
+	if stillLeased {
+		t.Fatalf("expected Ethernet1's lease to be gone after sweeping past its TTL")
+	}
+
+	// The freed address is handed back out to a fresh request for the same interface.
+	ip, _, ok = a.GetIP("Ethernet1")
+	if !ok || ip != "10.0.5.1" {
+		t.Fatalf("got ip=%s ok=%v, want the freed address to be reassigned", ip, ok)
+	}
+}
+
+func TestMemAllocatorReconfigureDrainsRemovedPools(t *testing.T) {
+	pools := []Pool{{Name: "p1", CIDR: "10.0.5.0/24", IfaceRegex: "Ethernet.*", PrefixLen: 24}}
+	a, err := newMemAllocator(pools, time.Minute)
+	if err != nil {
+		t.Fatalf("newMemAllocator: %v", err)
+	}
+	a.MarkSynced()
+
+	if _, _, ok := a.GetIP("Ethernet1"); !ok {
+		t.Fatalf("expected Ethernet1 to get a lease from p1")
+	}
+
+	// Removing p1 from the config should drain it rather than yank the existing lease.
+	if _, err := a.Reconfigure(nil, time.Minute); err != nil {
+		t.Fatalf("Reconfigure: %v", err)
+	}
+	if ip, _, ok := a.GetIP("Ethernet1"); !ok || ip != "10.0.5.1" {
+		t.Fatalf("existing lease from a draining pool should survive, got ip=%s ok=%v", ip, ok)
+	}
+	if _, _, ok := a.GetIP("Ethernet2"); ok {
+		t.Fatalf("a draining pool should not hand out new leases")
+	}
+}
@@ -4,6 +4,12 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/aristanetworks/glog"
 	"github.com/aristanetworks/goarista/gnmi"
@@ -37,42 +43,184 @@ func setPrefix(ctx context.Context, client pb.GNMIClient,
 func main() {
 	// Parse and validate command line arguments
 	cfg := &gnmi.Config{}
-	flag.StringVar(&cfg.Addr, "addr", "", "Address of gNMI gRPC server")
+	flag.StringVar(&cfg.Addr, "addr", "", "Address of gNMI gRPC server, for -mode=dialin")
 	flag.StringVar(&cfg.CAFile, "cafile", "", "Path to server TLS certificate file")
 	flag.StringVar(&cfg.CertFile, "certfile", "", "Path to client TLS certificate file")
 	flag.StringVar(&cfg.KeyFile, "keyfile", "", "Path to client TLS private key file")
 	flag.StringVar(&cfg.Password, "password", "", "Password to authenticate with")
 	flag.StringVar(&cfg.Username, "username", "", "Username to authenticate with")
 	flag.BoolVar(&cfg.TLS, "tls", false, "Enable TLS")
+
+	var mode string
+	flag.StringVar(&mode, "mode", "dialin", `gNMI mode to run in: "dialin" (subscribe to -addr) or `+
+		`"dialout" (listen on -listen for devices pushing their own SubscribeResponse streams)`)
+	var listenAddr string
+	flag.StringVar(&listenAddr, "listen", ":9339", "Address to listen on for -mode=dialout")
+	var serverCertFile, serverKeyFile string
+	flag.StringVar(&serverCertFile, "server-certfile", "", "Path to server TLS certificate file, for -mode=dialout")
+	flag.StringVar(&serverKeyFile, "server-keyfile", "", "Path to server TLS private key file, for -mode=dialout")
+
+	var poolsFile string
+	flag.StringVar(&poolsFile, "pools", "", "Path to a YAML file defining IP pools, one per interface-name regex "+
+		"(defaults to a single 10.0.0.0/16 pool for Ethernet interfaces)")
+	var leaseTTL time.Duration
+	flag.DurationVar(&leaseTTL, "lease-ttl", 5*time.Minute,
+		"How long an interface can stay adminDown before its IP is freed back to its pool")
+	var backend string
+	flag.StringVar(&backend, "backend", "bolt", `IP allocator backend: "memory" (lost on restart), "bolt" `+
+		`(persisted to -ipdb-file) or "etcd" (persisted to -etcd-endpoints)`)
+	var ipdbFile string
+	flag.StringVar(&ipdbFile, "ipdb-file", "inogf.db", "Path to the BoltDB file backing -backend=bolt")
+	var etcdEndpoints string
+	flag.StringVar(&etcdEndpoints, "etcd-endpoints", "", "Comma-separated etcd endpoints backing -backend=etcd "+
+		"(requires building with -tags etcd)")
+
+	var configFile string
+	flag.StringVar(&configFile, "config", "", "Path to a YAML file of reloadable settings (pools, lease-ttl, "+
+		"verbosity, subscribe-paths); reloaded on SIGHUP. Overrides -pools and -lease-ttl when given.")
+	var adminListen string
+	flag.StringVar(&adminListen, "admin-listen", "", "Address to serve /healthz and /configz on; disabled if empty")
 	flag.Parse()
-	if cfg.Addr == "" {
-		glog.Fatal("error: address not specified")
+
+	// Load the OpenConfig YANG modules we validate notifications against.
+	if err := loadSchema(); err != nil {
+		glog.Fatal(err)
+	}
+
+	var liveCfg *Config
+	if configFile != "" {
+		var err error
+		if liveCfg, err = loadConfig(configFile); err != nil {
+			glog.Fatal(err)
+		}
+	} else {
+		pools := defaultPools()
+		if poolsFile != "" {
+			var err error
+			if pools, err = loadPools(poolsFile); err != nil {
+				glog.Fatal(err)
+			}
+		}
+		liveCfg = &Config{
+			Pools:          pools,
+			LeaseTTL:       duration(leaseTTL),
+			SubscribePaths: []string{adminStatusPath, ipv4AddressPath},
+		}
 	}
 
-	// Init the IP database
-	initIPs(200, 24)
+	newAllocator, err := allocatorFactory(backend, ipdbFile, strings.Split(etcdEndpoints, ","))
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	status := &reloadStatus{}
+	status.record(liveCfg, nil)
+	if adminListen != "" {
+		go serveAdmin(adminListen, status)
+	}
+
+	switch mode {
+	case "dialin":
+		if cfg.Addr == "" {
+			glog.Fatal("error: address not specified")
+		}
+		err = runDialIn(cfg, newAllocator, liveCfg, configFile, status)
+	case "dialout":
+		err = runDialOut(cfg, listenAddr, serverCertFile, serverKeyFile, newAllocator, liveCfg, configFile, status)
+	default:
+		glog.Fatalf("error: unknown mode %q", mode)
+	}
+	if err != nil {
+		glog.Fatal(err)
+	}
+}
 
+// runDialIn connects out to cfg.Addr, subscribes to admin-status and ipv4 address updates, and
+// runs the event loop until the subscription fails. If configFile is set, its settings are
+// reloaded on SIGHUP; a changed subscribe path set re-opens the Subscribe below without
+// restarting the event loop, the Manager, or any of its state machines.
+func runDialIn(cfg *gnmi.Config, newAllocator func(target string, pools []Pool, leaseTTL time.Duration) (IPAllocator, error),
+	liveCfg *Config, configFile string, status *reloadStatus) error {
 	// Connect to the device via gNMI
 	ctx := gnmi.NewContext(context.Background(), cfg)
 	client, err := gnmi.Dial(cfg)
 	if err != nil {
-		glog.Fatal(err)
+		return err
 	}
 
-	// Create 2 channels for receiving gNMI messages.
-	respChan := make(chan *pb.SubscribeResponse)
+	msgChan := make(chan *message)
 	errChan := make(chan error)
-	// Close the channels when returning from this function.
-	defer close(respChan)
+	defer close(msgChan)
 	defer close(errChan)
-	// Subscribe to admin-status and ipv4 addresses updates.
-	// This will run in a different thread (or goroutine, as it's called in go) and will pass the
-	// messages to the respChan and errors on the errChan.
-	go gnmi.Subscribe(ctx, client,
-		gnmi.SplitPaths([]string{adminStatusPath, ipv4AddressPath}), respChan, errChan)
 
-	// Run the main event loop.
-	if err = eventLoop(ctx, client, respChan, errChan); err != nil {
-		glog.Fatal(err)
+	// subscribe (re)starts the gNMI Subscribe for the given paths, tagging every response with
+	// the target we dialed so it can share the event loop with dial-out sessions. The returned
+	// cancel func tears down this particular Subscribe so a later call can replace it.
+	subscribe := func(paths []string) context.CancelFunc {
+		subCtx, cancel := context.WithCancel(ctx)
+		rawRespChan := make(chan *pb.SubscribeResponse)
+		go func() {
+			opts := &gnmi.SubscribeOptions{Paths: gnmi.SplitPaths(paths)}
+			// SubscribeErr, unlike the deprecated Subscribe, doesn't close errChan itself, which
+			// matters here: a reload can call subscribe again on the same errChan to replace a
+			// changed path set, and subCtx.Err() != nil just means we cancelled it ourselves to do
+			// that, not that anything actually failed.
+			if err := gnmi.SubscribeErr(subCtx, client, opts, rawRespChan); err != nil && subCtx.Err() == nil {
+				errChan <- err
+			}
+		}()
+		go func() {
+			for {
+				select {
+				case resp, ok := <-rawRespChan:
+					if !ok {
+						return
+					}
+					msgChan <- &message{target: cfg.Addr, resp: resp}
+				case <-subCtx.Done():
+					return
+				}
+			}
+		}()
+		return cancel
 	}
+	cancelSubscribe := subscribe(liveCfg.SubscribePaths)
+	defer cancelSubscribe()
+
+	// There's only one client in dial-in mode, regardless of target.
+	clientFor := func(target string) (pb.GNMIClient, error) {
+		return client, nil
+	}
+
+	mgr := NewManager(ctx, clientFor, newAllocator, liveCfg)
+
+	var sig chan os.Signal
+	var reloadWG sync.WaitGroup
+	if configFile != "" {
+		reload := newReloader(configFile, liveCfg, mgr, status, func(paths []string) {
+			cancelSubscribe()
+			cancelSubscribe = subscribe(paths)
+		})
+		sig = make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGHUP)
+		reloadWG.Add(1)
+		go func() {
+			defer reloadWG.Done()
+			reload.watch(sig)
+		}()
+	}
+	// Stop any further SIGHUPs and let watch's range loop drain before Shutdown starts closing
+	// sm.events channels: otherwise a reload landing mid-Reconfigure could still be dispatching to
+	// a state machine whose channel Shutdown has just closed out from under it.
+	defer func() {
+		if sig != nil {
+			signal.Stop(sig)
+			close(sig)
+			reloadWG.Wait()
+		}
+		mgr.Shutdown()
+	}()
+
+	// Run the main event loop.
+	return eventLoop(mgr, msgChan, errChan)
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aristanetworks/glog"
+)
+
+// Manager owns the lifetime of every interfaceSm and the per-target IPAllocators they draw
+// leases from, replacing the old package-level interfaces and ipDBs maps. Centralizing them here
+// is what makes a clean Shutdown possible: there's one place that knows every goroutine and
+// allocator that needs to be drained and released. It also owns the live Config, so a SIGHUP
+// reload (see reloader) has one place to push pool/lease-TTL changes to every target at once.
+type Manager struct {
+	ctx       context.Context
+	clientFor clientProvider
+
+	// newAllocator builds the IPAllocator for a target the first time it's seen, using cfg's
+	// pools and lease TTL at that moment. Set once at construction by allocatorFactory, which is
+	// where the chosen backend is baked in.
+	newAllocator func(target string, pools []Pool, leaseTTL time.Duration) (IPAllocator, error)
+
+	mu         sync.Mutex // guards cfg/sms/allocators; never held while sending on an sm's events channel
+	cfg        *Config
+	sms        map[smKey]*interfaceSm
+	allocators map[string]IPAllocator
+
+	wg sync.WaitGroup
+}
+
+// NewManager creates a Manager. ctx is used for every gNMI call made on behalf of the state
+// machines it owns, and is expected to be cancelled (by the caller, after Shutdown) to tear down
+// any in-flight requests. cfg is the pools/lease-TTL configuration in effect until the first
+// reload, if any.
+func NewManager(ctx context.Context, clientFor clientProvider,
+	newAllocator func(target string, pools []Pool, leaseTTL time.Duration) (IPAllocator, error),
+	cfg *Config) *Manager {
+	return &Manager{
+		ctx:          ctx,
+		clientFor:    clientFor,
+		newAllocator: newAllocator,
+		cfg:          cfg,
+		sms:          make(map[smKey]*interfaceSm),
+		allocators:   make(map[string]IPAllocator),
+	}
+}
+
+// allocatorFor returns the IPAllocator for target, creating it (from the currently configured
+// pools/lease TTL) on first use. newAllocator can block (the bolt backend, for one, does file
+// I/O), so it's called with m.mu released: holding the shared mutex across it would stall every
+// other target's dispatch until this one's allocator finishes opening.
+func (m *Manager) allocatorFor(target string) IPAllocator {
+	m.mu.Lock()
+	if a, ok := m.allocators[target]; ok {
+		m.mu.Unlock()
+		return a
+	}
+	pools, leaseTTL := m.cfg.Pools, time.Duration(m.cfg.LeaseTTL)
+	m.mu.Unlock()
+
+	a, err := m.newAllocator(target, pools, leaseTTL)
+	if err != nil {
+		glog.Fatalf("Unable to create IP allocator for %s: %v", target, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if existing, ok := m.allocators[target]; ok {
+		return existing
+	}
+	m.allocators[target] = a
+	return a
+}
+
+// smFor returns the state machine for (target, iface), creating it and starting its event-loop
+// goroutine on first use.
+func (m *Manager) smFor(target, iface string) *interfaceSm {
+	key := smKey{target: target, iface: iface}
+
+	m.mu.Lock()
+	sm, ok := m.sms[key]
+	if !ok {
+		sm = newInterfaceSm(m, target, iface)
+		m.sms[key] = sm
+		m.wg.Add(1)
+		go sm.run(&m.wg)
+	}
+	m.mu.Unlock()
+
+	return sm
+}
+
+// dispatch hands ev to the (target, iface) state machine's own goroutine, starting it first if
+// this is the first event seen for that pair. This is the only way events reach an interfaceSm:
+// applyUpdate is never called directly from eventLoop, so each state machine's transitions are
+// strictly serialized without needing a mutex of its own.
+func (m *Manager) dispatch(target, iface string, ev smEvent) {
+	m.smFor(target, iface).events <- ev
+}
+
+// Reconfigure applies a freshly reloaded Config to every target's allocator: new pools become
+// available, removed ones start draining, and changed prefix lengths are pushed back out to the
+// affected interfaces by re-running them through configured(). Future targets seen for the first
+// time after this call get allocators built from cfg, not whatever was in effect at startup.
+func (m *Manager) Reconfigure(cfg *Config) {
+	m.mu.Lock()
+	m.cfg = cfg
+	allocators := make(map[string]IPAllocator, len(m.allocators))
+	for target, a := range m.allocators {
+		allocators[target] = a
+	}
+	m.mu.Unlock()
+
+	for target, a := range allocators {
+		affected, err := a.Reconfigure(cfg.Pools, time.Duration(cfg.LeaseTTL))
+		if err != nil {
+			glog.Errorf("Reconfiguring IP allocator for %s: %v", target, err)
+			continue
+		}
+		for _, iface := range affected {
+			m.dispatch(target, iface, smEvent{reconfigure: true})
+		}
+	}
+}
+
+// Shutdown stops every state machine's goroutine and releases the leases they were holding. It
+// does not cancel ctx itself; the caller should do that once Shutdown returns, or beforehand to
+// unblock any gNMI call a state machine is in the middle of.
+func (m *Manager) Shutdown() {
+	m.mu.Lock()
+	sms := make([]*interfaceSm, 0, len(m.sms))
+	for _, sm := range m.sms {
+		sms = append(sms, sm)
+	}
+	m.mu.Unlock()
+
+	for _, sm := range sms {
+		close(sm.events)
+	}
+	m.wg.Wait()
+
+	for _, sm := range sms {
+		m.allocatorFor(sm.target).ReleaseIP(sm.name)
+	}
+}
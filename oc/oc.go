@@ -0,0 +1,68 @@
+// Package oc contains the small subset of Go bindings for the OpenConfig "interfaces" and
+// "openconfig-if-ip" YANG modules (see ../yang) that inogf needs. In a full ygot setup these
+// would be produced by generator.go via `go generate`; they're hand-trimmed here to just the
+// leaves inogf reads and writes.
+package oc
+
+// AdminStatus mirrors the "state/admin-status" leaf of openconfig-interfaces.
+type AdminStatus int
+
+const (
+	AdminStatus_UNSET AdminStatus = iota
+	AdminStatus_UP
+	AdminStatus_DOWN
+)
+
+// Interface corresponds to /interfaces/interface.
+type Interface struct {
+	Name         string
+	AdminStatus  AdminStatus
+	Subinterface map[uint32]*Interface_Subinterface
+}
+
+// Interface_Subinterface corresponds to /interfaces/interface/subinterfaces/subinterface.
+type Interface_Subinterface struct {
+	Index uint32
+	Ipv4  *Interface_Subinterface_Ipv4
+}
+
+// Interface_Subinterface_Ipv4 corresponds to .../subinterface/ipv4, augmented in from
+// openconfig-if-ip.
+type Interface_Subinterface_Ipv4 struct {
+	Address map[string]*Interface_Subinterface_Ipv4_Address
+}
+
+// Interface_Subinterface_Ipv4_Address corresponds to .../ipv4/addresses/address.
+type Interface_Subinterface_Ipv4_Address struct {
+	Ip           string
+	PrefixLength *uint8
+}
+
+// subinterface returns the subinterface at the given index, creating it (and the Subinterface
+// map, if needed) first.
+func (i *Interface) subinterface(index uint32) *Interface_Subinterface {
+	if i.Subinterface == nil {
+		i.Subinterface = make(map[uint32]*Interface_Subinterface)
+	}
+	sub, ok := i.Subinterface[index]
+	if !ok {
+		sub = &Interface_Subinterface{Index: index}
+		i.Subinterface[index] = sub
+	}
+	return sub
+}
+
+// Address returns the ipv4 address leaf of the interface at the given subinterface index,
+// creating any intermediate containers needed to reach it.
+func (i *Interface) Address(subIndex uint32, ip string) *Interface_Subinterface_Ipv4_Address {
+	sub := i.subinterface(subIndex)
+	if sub.Ipv4 == nil {
+		sub.Ipv4 = &Interface_Subinterface_Ipv4{Address: make(map[string]*Interface_Subinterface_Ipv4_Address)}
+	}
+	addr, ok := sub.Ipv4.Address[ip]
+	if !ok {
+		addr = &Interface_Subinterface_Ipv4_Address{Ip: ip}
+		sub.Ipv4.Address[ip] = addr
+	}
+	return addr
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Pool describes one IP pool: addresses carved out of cidr are handed out, with the given
+// prefix length, to interfaces whose name matches ifaceRegex.
+type Pool struct {
+	Name       string `yaml:"name"`
+	CIDR       string `yaml:"cidr"`
+	IfaceRegex string `yaml:"iface-regex"`
+	PrefixLen  int    `yaml:"prefix-length"`
+}
+
+// loadPools reads pool definitions from a YAML file of the form:
+//
+//   - name: ethernet
+//     cidr: 10.0.0.0/16
+//     iface-regex: "Ethernet.*"
+//     prefix-length: 24
+func loadPools(path string) ([]Pool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var pools []Pool
+	if err := yaml.Unmarshal(data, &pools); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return pools, nil
+}
+
+// defaultPools preserves the original hard-coded "10.0.<i>.1/24" behavior for Ethernet
+// interfaces, used when no -pools file is given.
+func defaultPools() []Pool {
+	return []Pool{{
+		Name:       "default",
+		CIDR:       "10.0.0.0/16",
+		IfaceRegex: "Ethernet.*",
+		PrefixLen:  24,
+	}}
+}
+
+// generateIPs enumerates the addresses belonging to cidr. For a cidr of /24 or smaller (a longer
+// prefix), it hands out the single first usable host address within that one subnet. For a wider
+// cidr, it hands out one address (the ".1" of each of its first 254 /24s, at most) per
+// subinterface, mirroring the original "10.0.<i>.1" scheme, rather than trying to carve host
+// addresses out of a single flat subnet.
+func generateIPs(cidr string) (map[string]string, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ip4 := ipnet.IP.To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("only IPv4 pools are supported: %s", cidr)
+	}
+
+	ones, _ := ipnet.Mask.Size()
+	if ones >= 24 {
+		ip := net.IPv4(ip4[0], ip4[1], ip4[2], ip4[3]+1).String()
+		return map[string]string{ip: ""}, nil
+	}
+
+	count := 1 << uint(24-ones)
+	if count > 254 {
+		count = 254
+	}
+
+	ips := make(map[string]string, count)
+	for i := 0; i < count; i++ {
+		ips[net.IPv4(ip4[0], ip4[1], ip4[2]+byte(i), 1).String()] = ""
+	}
+	return ips, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"reflect"
+	"strconv"
+
+	"github.com/aristanetworks/glog"
+)
+
+// reloader re-reads a Config file on every SIGHUP and applies whatever changed: pools and the
+// lease TTL go to mgr.Reconfigure, verbosity is pushed straight into glog's -v flag, and a
+// changed subscribe path set is handed to onPathsChanged so the gNMI session can re-subscribe
+// without tearing down the Manager or any of its state machines.
+type reloader struct {
+	path           string
+	mgr            *Manager
+	status         *reloadStatus
+	onPathsChanged func(paths []string)
+
+	cfg *Config
+}
+
+// newReloader wires a reloader up to watch path for future SIGHUP reloads. cfg is whatever was
+// already loaded from path at startup; newReloader applies its verbosity immediately, since a
+// plain startup load never goes through reload().
+func newReloader(path string, cfg *Config, mgr *Manager, status *reloadStatus,
+	onPathsChanged func(paths []string)) *reloader {
+	applyVerbosity(cfg.Verbosity)
+	return &reloader{path: path, mgr: mgr, status: status, onPathsChanged: onPathsChanged, cfg: cfg}
+}
+
+// watch reloads r.path every time a signal arrives on sig, until sig is closed.
+func (r *reloader) watch(sig <-chan os.Signal) {
+	for range sig {
+		r.reload()
+	}
+}
+
+func (r *reloader) reload() {
+	cfg, err := loadConfig(r.path)
+	if err != nil {
+		glog.Errorf("Reloading config from %s: %v", r.path, err)
+		r.status.record(nil, err)
+		return
+	}
+
+	pathsChanged := !reflect.DeepEqual(cfg.SubscribePaths, r.cfg.SubscribePaths)
+
+	r.mgr.Reconfigure(cfg)
+	applyVerbosity(cfg.Verbosity)
+	if pathsChanged {
+		glog.Infof("Subscribed paths changed on reload, re-opening gNMI Subscribe")
+		r.onPathsChanged(cfg.SubscribePaths)
+	}
+
+	r.cfg = cfg
+	r.status.record(cfg, nil)
+	glog.Infof("Reloaded config from %s", r.path)
+}
+
+// applyVerbosity updates glog's -v flag in place, equivalent to what passing a different -v on
+// the command line would have done at startup.
+func applyVerbosity(v int32) {
+	f := flag.Lookup("v")
+	if f == nil {
+		return
+	}
+	if err := f.Value.Set(strconv.Itoa(int(v))); err != nil {
+		glog.Errorf("Setting verbosity to %d: %v", v, err)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/openconfig/goyang/pkg/yang"
+)
+
+// yangDir holds the (trimmed) OpenConfig YANG modules we validate gNMI paths against.
+const yangDir = "yang"
+
+// schema is the parsed YANG tree for the "interfaces" and "ip" modules, built once at startup.
+// We walk it while parsing notifications so that we're matching against the actual schema
+// instead of a hand-rolled regexp.
+var schema *yang.Entry
+
+// loadSchema parses the YANG modules in yangDir and builds their combined schema tree. It must
+// be called once, before the first gNMI notification is processed.
+func loadSchema() error {
+	ms := yang.NewModules()
+	for _, f := range []string{"openconfig-interfaces.yang", "openconfig-if-ip.yang"} {
+		if err := ms.Read(filepath.Join(yangDir, f)); err != nil {
+			return err
+		}
+	}
+	if errs := ms.Process(); len(errs) > 0 {
+		return errs[0]
+	}
+
+	root, ok := ms.Modules["openconfig-interfaces"]
+	if !ok {
+		return fmt.Errorf("module %q not found after parsing %s", "openconfig-interfaces", yangDir)
+	}
+	schema = yang.ToEntry(root)
+	return nil
+}